@@ -1,8 +1,9 @@
 package main
 
 import (
-	"archive/zip"
-	"errors"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -10,14 +11,11 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
-	uuid "github.com/satori/go.uuid"
 )
 
 const (
@@ -26,224 +24,228 @@ const (
 )
 
 var (
-	usernameFlag string
-	zipFlag      bool
-	pageStr      string
+	usernameFlag     string
+	outputFlag       string
+	quietFlag        bool
+	pageWorkersFlag  int
+	imageWorkersFlag int
+	rpsFlag          float64
+	timeoutFlag      time.Duration
+	maxRetriesFlag   int
+	retryBaseFlag    time.Duration
+	retryFromFlag    string
+	rebuildFlag      string
+	incrementalFlag  bool
 )
 
-// processImage will go into the photo link and save the image
-func processImage(url string) error {
-	doc, err := goquery.NewDocument(url)
-	if err != nil {
-		return fmt.Errorf("Error on fetching %s", url)
-	}
-
-	// getting image url
-	imageURL, _ := doc.Find("a.wall_img_container_big > img").Attr("src")
-
-	// creating the image file
-	filename := fmt.Sprintf(outputFolder+"/image-%s.jpg", uuid.NewV4())
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("could not create image file %s: %v", filename, err)
+// processImage will go into the photo link, resolve the real image URL and
+// save it under a content-hash name via out. detailURL and already-seen
+// image content are skipped via m, so re-running against the same profile
+// turns into an incremental sync instead of a full re-download. prog's
+// total bar is advanced as the image body is read. Both fetches go through
+// rp, so transient failures are retried before being reported.
+func processImage(client *http.Client, rp *retryPolicy, m *manifest, prog *progress, out output, detailURL string) error {
+	if _, ok := m.lookupURL(detailURL); ok {
+		return nil
 	}
-	defer file.Close()
 
-	// getting the image from fotolog page and saving it
-	resp, err := http.Get(imageURL)
+	resp, err := rp.get(client, detailURL)
 	if err != nil {
-		return fmt.Errorf("could not get image %s: %v", imageURL, err)
+		return fmt.Errorf("Error on fetching %s: %v", detailURL, err)
 	}
 	defer resp.Body.Close()
 
-	_, err = io.Copy(file, resp.Body)
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
 	if err != nil {
-		return fmt.Errorf("could not save file %s: %v", filename, err)
+		return fmt.Errorf("Error on parsing %s: %v", detailURL, err)
 	}
 
-	return nil
-}
-
-// processPage will grab all image links and call the image processor
-func processPage(doc *goquery.Document, wg *sync.WaitGroup) int {
-	imagesProcessed := 0
-	doc.Find("a.wall_img_container").Each(func(i int, s *goquery.Selection) {
-		link, _ := s.Attr("href")
-		wg.Add(1)
-		go func(link string) {
-			defer wg.Done()
-			err := processImage(link)
-			if err == nil {
-				imagesProcessed++
-			}
-		}(link)
-	})
-	return imagesProcessed
-}
+	// getting image url
+	imageURL, _ := doc.Find("a.wall_img_container_big > img").Attr("src")
 
-// zipImages will create the zipfile for the downloaded images folder
-func zipImages() error {
-	// check if we got the images directory
-	_, err := os.Stat(outputFolder)
+	// getting the image from fotolog page
+	imgResp, err := rp.get(client, imageURL)
 	if err != nil {
-		return errors.New("images folder does not exists")
+		return fmt.Errorf("could not get image %s: %v", imageURL, err)
 	}
+	defer imgResp.Body.Close()
 
-	// create zip file
-	zipFile, err := os.Create("./images.zip")
+	data, err := ioutil.ReadAll(prog.wrap(imgResp.Body))
 	if err != nil {
-		return err
+		return fmt.Errorf("could not read image %s: %v", imageURL, err)
 	}
 
-	archive := zip.NewWriter(zipFile)
-	defer archive.Close()
-
-	filepath.Walk(outputFolder, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return fmt.Errorf("Error on walking to %s: %v", path, err)
-		}
-
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			header.Name += "/"
-		}
-		header.Method = zip.Store
-
-		writer, err := archive.CreateHeader(header)
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		if header.Mode().IsRegular() {
-			file, err := os.Open(path)
-
-			if err != nil {
-				return fmt.Errorf("error on opening %s: %v", path, err)
-			}
-			defer file.Close()
-
-			_, err = io.CopyN(writer, file, info.Size())
-			if err != nil && err != io.EOF {
-				return fmt.Errorf("could not add image to zip: %v", err)
-			}
-		}
-
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if existing, ok := m.lookupHash(hash); ok {
+		m.record(manifestEntry{
+			DetailURL:   detailURL,
+			ImageURL:    imageURL,
+			SHA256:      hash,
+			Name:        existing.Name,
+			Size:        existing.Size,
+			CompletedAt: time.Now(),
+		})
 		return nil
-	})
-
-	return nil
-}
+	}
 
-// deleteOutputFolder will delete the current images folder after the zip creation
-func deleteOutputFolder() error {
-	// check if zip file exists
-	_, err := os.Stat("./images.zip")
-	if err != nil {
-		return fmt.Errorf("images.zip file does not exists. Skipping output folder delete")
+	// new content: save it under a hash-derived name so identical images
+	// encountered via different detail URLs collapse to one entry
+	name := hash + ".jpg"
+	meta := imageMeta{
+		DetailURL:      detailURL,
+		ImageURL:       imageURL,
+		SHA256:         hash,
+		Size:           int64(len(data)),
+		CompletedAt:    time.Now(),
+		RequestMethod:  imgResp.Request.Method,
+		RequestHeader:  imgResp.Request.Header,
+		ResponseStatus: imgResp.StatusCode,
+		ResponseHeader: imgResp.Header,
 	}
 
-	files, err := ioutil.ReadDir(outputFolder)
+	w, err := out.Create(name, meta)
 	if err != nil {
-		return fmt.Errorf("could not read from images folder: %v", err)
+		return fmt.Errorf("could not create output entry %s: %v", name, err)
 	}
-
-	for _, file := range files {
-		err := os.Remove(filepath.Join(outputFolder, file.Name()))
-		if err != nil {
-			return fmt.Errorf("could not remove %s: %v", file.Name(), err)
-		}
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		w.Close()
+		return fmt.Errorf("could not save %s: %v", name, err)
 	}
-
-	if err = os.Remove(outputFolder); err != nil {
-		return fmt.Errorf("could not remove images folder: %v", err)
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("could not finalize %s: %v", name, err)
 	}
+
+	m.record(manifestEntry{
+		DetailURL:   detailURL,
+		ImageURL:    imageURL,
+		SHA256:      hash,
+		Name:        name,
+		Size:        meta.Size,
+		CompletedAt: meta.CompletedAt,
+	})
+
 	return nil
 }
 
 func init() {
 	flag.StringVar(&usernameFlag, "username", "", "username")
-	flag.BoolVar(&zipFlag, "zip", false, "zip images")
+	flag.StringVar(&outputFlag, "output", "dir", "output backend: dir, zip, warc, or s3://bucket/prefix")
+	flag.BoolVar(&quietFlag, "quiet", false, "disable progress bars and fall back to plain logs")
+	flag.IntVar(&pageWorkersFlag, "page-workers", 4, "number of concurrent mosaic page fetchers")
+	flag.IntVar(&imageWorkersFlag, "image-workers", 8, "number of concurrent image downloaders")
+	flag.Float64Var(&rpsFlag, "rps", 5, "max requests per second against fotolog (<= 0 disables throttling)")
+	flag.DurationVar(&timeoutFlag, "timeout", 30*time.Second, "per-request HTTP timeout")
+	flag.IntVar(&maxRetriesFlag, "max-retries", 3, "max retries for transient HTTP failures")
+	flag.DurationVar(&retryBaseFlag, "retry-base", 500*time.Millisecond, "base delay for retry backoff")
+	flag.StringVar(&retryFromFlag, "retry-from", "", "re-drive only the URLs recorded in this errors.jsonl file, skipping page discovery")
+	flag.StringVar(&rebuildFlag, "rebuild", "", "rebuild a full archive at this -output-style spec (zip, warc, s3://bucket/prefix) from every image already saved locally, without re-crawling fotolog")
+	flag.BoolVar(&incrementalFlag, "incremental", false, "with -output=zip, package only this run's new images instead of growing images.zip to hold every image ever synced")
 }
 
 func main() {
 	t0 := time.Now()
 	flag.Parse()
-	if len(usernameFlag) == 0 {
+
+	if rebuildFlag != "" {
+		m, err := loadManifest(manifestPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := rebuildOutput(m, rebuildFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(usernameFlag) == 0 && retryFromFlag == "" {
 		fmt.Println("Please provide an username")
 		os.Exit(1)
 	}
 
-	// create output dir
-	if err := os.Mkdir("images", os.ModePerm); err != nil {
-		if !os.IsExist(err) {
+	out, err := newOutput(outputFlag, incrementalFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m, err := loadManifest(manifestPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Read back any URLs to retry before opening errorsPath for writing: the
+	// -retry-from flag's own documented usage is "-retry-from errors.jsonl",
+	// the same relative path errorsPath names, so opening it first would
+	// truncate the very file we're about to read.
+	var retryURLs []string
+	if retryFromFlag != "" {
+		retryURLs, err = loadErrorURLs(retryFromFlag)
+		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
-	url := fmt.Sprintf(fotologURL, usernameFlag, "")
-
-	// processing first page to get the last page
-	doc, err := goquery.NewDocument(url)
+	errs, err := newErrorSink(errorsPath)
 	if err != nil {
-		log.Fatalf("Error on fetching %s", url)
+		log.Fatal(err)
 	}
 
-	// syncing all goroutines
-	wg := sync.WaitGroup{}
-
-	// getting last page as an int value
-	lastLink, _ := doc.Find("#pagination > a:last-child").Last().Attr("href")
-	lastPage, _ := strconv.Atoi(strings.Split(lastLink, "/")[5])
+	prog, err := newProgress(pageWorkersFlag, quietFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// processing first page since we already fetched it
-	fmt.Println("Processing", url)
-	wg.Add(1)
-	go func(doc *goquery.Document) {
-		defer wg.Done()
-		processPage(doc, &wg)
-	}(doc)
+	cfg := pipelineConfig{
+		PageWorkers:  pageWorkersFlag,
+		ImageWorkers: imageWorkersFlag,
+		Timeout:      timeoutFlag,
+		RPS:          rpsFlag,
+		MaxRetries:   maxRetriesFlag,
+		RetryBase:    retryBaseFlag,
+	}
+	p := newPipeline(cfg, m, prog, out, errs)
 
-	// processing remaining pages
-	// for each page we process their images
-	for i := 30; i <= lastPage; i += 30 {
-		wg.Add(1)
-		pageStr = strconv.Itoa(i)
-		url = fmt.Sprintf(fotologURL, usernameFlag, pageStr)
-		fmt.Println("Processing", url)
+	if retryFromFlag != "" {
+		p.runURLs(retryURLs)
+	} else {
+		client := &http.Client{Timeout: timeoutFlag}
+		url := fmt.Sprintf(fotologURL, usernameFlag, "")
 
-		doc, err := goquery.NewDocument(url)
+		// fetching the first page just to discover the last page number
+		resp, err := client.Get(url)
 		if err != nil {
 			log.Fatalf("Error on fetching %s", url)
-			continue
 		}
+		doc, err := goquery.NewDocumentFromReader(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Fatalf("Error on parsing %s: %v", url, err)
+		}
+
+		// getting last page as an int value
+		lastLink, _ := doc.Find("#pagination > a:last-child").Last().Attr("href")
+		lastPage, _ := strconv.Atoi(strings.Split(lastLink, "/")[5])
 
-		go func(doc *goquery.Document) {
-			defer wg.Done()
-			processPage(doc, &wg)
-		}(doc)
+		p.run(usernameFlag, lastPage)
 	}
-	wg.Wait()
 
-	if zipFlag {
-		// zip images folder
-		if err = zipImages(); err != nil {
-			log.Fatalf("Could not create zip image file: %v", err)
-		}
+	if err := m.save(); err != nil {
+		log.Fatal(err)
+	}
 
-		// remove output folder
-		if err := deleteOutputFolder(); err != nil {
-			log.Fatalf("Could not remove images folder: %v", err)
-		}
+	if err := out.Finalize(); err != nil {
+		log.Fatalf("Could not finalize output: %v", err)
+	}
+
+	if err := errs.close(); err != nil {
+		log.Fatalf("Could not finalize %s: %v", errorsPath, err)
 	}
 
+	imagesOK, imagesFail, bytesDown := prog.finish()
+
 	t1 := time.Since(t0)
-	fmt.Printf("elapsed time: %.2f seconds\n", t1.Seconds())
+	mb := float64(bytesDown) / (1024 * 1024)
+	fmt.Printf("%d images downloaded, %d failed, %.2f MB in %.2f seconds (%.2f images/sec)\n",
+		imagesOK, imagesFail, mb, t1.Seconds(), float64(imagesOK)/t1.Seconds())
 }
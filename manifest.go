@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// manifestPath is the dedup/resume index kept alongside the output folder.
+const manifestPath = "./manifest.json"
+
+// manifestEntry records everything needed to skip a photo on a future run
+// and to verify what was actually saved. Name is the identifier it was
+// saved under in the active output backend (a relative path for dir/zip, a
+// key for s3, etc).
+type manifestEntry struct {
+	DetailURL   string    `json:"detail_url"`
+	ImageURL    string    `json:"image_url"`
+	SHA256      string    `json:"sha256"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// manifest tracks which photos have already been downloaded, keyed both by
+// detail URL (so a re-run can skip a page it already walked) and by content
+// SHA-256 (so the same image reached via two different detail URLs collapses
+// to a single output entry). Because lookups skip anything already known,
+// every output backend naturally only receives this run's new images.
+type manifest struct {
+	mu   sync.Mutex
+	path string
+
+	byURL  map[string]manifestEntry
+	byHash map[string]manifestEntry
+}
+
+// loadManifest reads path if it exists, or returns an empty manifest ready
+// to be populated and saved to it.
+func loadManifest(path string) (*manifest, error) {
+	m := &manifest{
+		path:   path,
+		byURL:  make(map[string]manifestEntry),
+		byHash: make(map[string]manifestEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest %s: %v", path, err)
+	}
+
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %v", path, err)
+	}
+	for _, e := range entries {
+		m.byURL[e.DetailURL] = e
+		m.byHash[e.SHA256] = e
+	}
+
+	return m, nil
+}
+
+// lookupURL reports whether detailURL has already been downloaded.
+func (m *manifest) lookupURL(detailURL string) (manifestEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.byURL[detailURL]
+	return e, ok
+}
+
+// lookupHash reports whether content with the given SHA-256 has already
+// been saved, regardless of which detail URL it was first seen under.
+func (m *manifest) lookupHash(sum string) (manifestEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.byHash[sum]
+	return e, ok
+}
+
+// record adds entry to the in-memory indexes. It does not persist to disk;
+// call save for that.
+func (m *manifest) record(entry manifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.byURL[entry.DetailURL] = entry
+	m.byHash[entry.SHA256] = entry
+}
+
+// uniqueEntries returns one entry per distinct piece of content (i.e. per
+// file the dir backend actually holds), collapsing the duplicate detail-URL
+// entries that byURL carries for images reached more than one way. Used to
+// rebuild a full archive from what's already on disk.
+func (m *manifest) uniqueEntries() []manifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]manifestEntry, 0, len(m.byHash))
+	for _, e := range m.byHash {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// save writes the full manifest back to disk as a JSON array.
+func (m *manifest) save() error {
+	m.mu.Lock()
+	entries := make([]manifestEntry, 0, len(m.byURL))
+	for _, e := range m.byURL {
+		entries = append(entries, e)
+	}
+	m.mu.Unlock()
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal manifest: %v", err)
+	}
+	if err := os.WriteFile(m.path, data, 0644); err != nil {
+		return fmt.Errorf("could not write manifest %s: %v", m.path, err)
+	}
+	return nil
+}
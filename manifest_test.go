@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestSaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+
+	m, err := loadManifest(path)
+	if err != nil {
+		t.Fatalf("loadManifest(nonexistent) = %v", err)
+	}
+
+	m.record(manifestEntry{
+		DetailURL:   "http://example.com/detail/1",
+		ImageURL:    "http://example.com/img/1.jpg",
+		SHA256:      "abc123",
+		Name:        "abc123.jpg",
+		Size:        42,
+		CompletedAt: time.Now().Truncate(time.Second),
+	})
+
+	if err := m.save(); err != nil {
+		t.Fatalf("save() = %v", err)
+	}
+
+	reloaded, err := loadManifest(path)
+	if err != nil {
+		t.Fatalf("loadManifest(after save) = %v", err)
+	}
+
+	entry, ok := reloaded.lookupURL("http://example.com/detail/1")
+	if !ok {
+		t.Fatal("lookupURL did not find the entry saved in the prior run")
+	}
+	if entry.SHA256 != "abc123" || entry.Name != "abc123.jpg" {
+		t.Errorf("reloaded entry = %+v, want sha256 abc123 / name abc123.jpg", entry)
+	}
+}
+
+func TestManifestHashCollapse(t *testing.T) {
+	m, err := loadManifest(filepath.Join(t.TempDir(), "manifest.json"))
+	if err != nil {
+		t.Fatalf("loadManifest = %v", err)
+	}
+
+	first := manifestEntry{
+		DetailURL: "http://example.com/detail/1",
+		SHA256:    "deadbeef",
+		Name:      "deadbeef.jpg",
+	}
+	m.record(first)
+
+	// A second detail URL carrying the same content hash should be
+	// recognized via lookupHash, so its caller can reuse first's Name
+	// instead of saving the bytes again.
+	existing, ok := m.lookupHash("deadbeef")
+	if !ok {
+		t.Fatal("lookupHash did not find the first entry's hash")
+	}
+
+	second := manifestEntry{
+		DetailURL: "http://example.com/detail/2",
+		SHA256:    existing.SHA256,
+		Name:      existing.Name,
+	}
+	m.record(second)
+
+	if _, ok := m.lookupURL("http://example.com/detail/1"); !ok {
+		t.Fatal("lookupURL lost the first detail URL after recording the second")
+	}
+	if _, ok := m.lookupURL("http://example.com/detail/2"); !ok {
+		t.Fatal("lookupURL did not find the second detail URL")
+	}
+
+	unique := m.uniqueEntries()
+	if len(unique) != 1 {
+		t.Fatalf("uniqueEntries() = %d entries, want 1 (both detail URLs share one hash)", len(unique))
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// imageMeta is the provenance recorded for a single downloaded image,
+// passed to an output backend so it can name and tag the file as needed.
+// RequestHeader/ResponseHeader are the actual headers captured off the
+// image fetch, for backends (like warc) that archive them alongside the
+// bytes.
+type imageMeta struct {
+	DetailURL   string
+	ImageURL    string
+	SHA256      string
+	Size        int64
+	CompletedAt time.Time
+
+	RequestMethod  string
+	RequestHeader  http.Header
+	ResponseStatus int
+	ResponseHeader http.Header
+}
+
+// output is implemented by each storage backend a downloaded image can be
+// saved to, selected at runtime via -output.
+type output interface {
+	// Create opens name for writing; closing the returned writer finalizes
+	// that single file.
+	Create(name string, meta imageMeta) (io.WriteCloser, error)
+	// Finalize flushes and closes the backend once every image has been
+	// written.
+	Finalize() error
+}
+
+// newOutput builds the backend named by spec: "dir" (the default, one file
+// per image under outputFolder), "zip" (stream into images.zip), "warc"
+// (append WARC/1.0 request/response record pairs, headers included, to a
+// single images.warc), or "s3://bucket/prefix". incremental only affects
+// zip: when true, images.zip is rewritten from scratch with just this run's
+// new images each time instead of growing to hold every image ever synced.
+func newOutput(spec string, incremental bool) (output, error) {
+	switch {
+	case spec == "" || spec == "dir":
+		return newDirOutput(outputFolder)
+	case spec == "zip":
+		return newZipOutput("./images.zip", incremental)
+	case spec == "warc":
+		return newWarcOutput("./images.warc")
+	case strings.HasPrefix(spec, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(spec, "s3://"), "/")
+		return newS3Output(bucket, prefix)
+	default:
+		return nil, fmt.Errorf("unknown -output backend %q", spec)
+	}
+}
+
+// rebuildOutput re-materializes every unique image m knows about into a
+// fresh backend built from spec, reading the bytes back from dirOutput's
+// outputFolder rather than re-downloading them from fotolog. This is how a
+// full zip/warc/s3 bundle can be produced after one or more incremental
+// -output=dir (the default) runs, since every other backend only ever
+// receives a run's new images.
+func rebuildOutput(m *manifest, spec string) error {
+	out, err := newOutput(spec, false)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range m.uniqueEntries() {
+		data, err := os.ReadFile(filepath.Join(outputFolder, entry.Name))
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", entry.Name, err)
+		}
+
+		w, err := out.Create(entry.Name, imageMeta{
+			DetailURL:   entry.DetailURL,
+			ImageURL:    entry.ImageURL,
+			SHA256:      entry.SHA256,
+			Size:        entry.Size,
+			CompletedAt: entry.CompletedAt,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return fmt.Errorf("could not write %s: %v", entry.Name, err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("could not finalize %s: %v", entry.Name, err)
+		}
+	}
+
+	return out.Finalize()
+}
+
+// dirOutput saves each image as its own file under dir: the original,
+// pre-pluggable-backend behavior.
+type dirOutput struct {
+	dir string
+}
+
+func newDirOutput(dir string) (*dirOutput, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create output dir %s: %v", dir, err)
+	}
+	return &dirOutput{dir: dir}, nil
+}
+
+func (o *dirOutput) Create(name string, meta imageMeta) (io.WriteCloser, error) {
+	return os.Create(filepath.Join(o.dir, name))
+}
+
+func (o *dirOutput) Finalize() error { return nil }
+
+// zipOutput streams images straight into a zip archive as they arrive,
+// replacing the old write-to-disk-then-rezip flow. Unless incremental is
+// set, opening it carries forward whatever path already held from a prior
+// run, so a second sync against the same profile grows the archive instead
+// of clobbering it; with incremental set, it packages only this run's new
+// images, matching the original -incremental request.
+type zipOutput struct {
+	mu      sync.Mutex
+	file    *os.File
+	archive *zip.Writer
+	path    string
+	tmpPath string
+}
+
+func newZipOutput(path string, incremental bool) (*zipOutput, error) {
+	var r *zip.ReadCloser
+	if !incremental {
+		var err error
+		r, err = zip.OpenReader(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("could not open existing zip %s: %v", path, err)
+		}
+		if r != nil {
+			// zip.File.Open reads lazily off r's underlying file, so it
+			// must stay open until every entry has been carried forward.
+			defer r.Close()
+		}
+	}
+
+	// Writing happens into a temp file so the original stays intact (and
+	// readable by the OpenReader above) until Finalize swaps it in.
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s: %v", tmpPath, err)
+	}
+	archive := zip.NewWriter(f)
+
+	if r != nil {
+		for _, zf := range r.File {
+			if err := carryForwardZipEntry(archive, zf); err != nil {
+				archive.Close()
+				f.Close()
+				return nil, fmt.Errorf("could not carry forward %s from %s: %v", zf.Name, path, err)
+			}
+		}
+	}
+
+	return &zipOutput{file: f, archive: archive, path: path, tmpPath: tmpPath}, nil
+}
+
+// carryForwardZipEntry copies one entry from a previously-written zip into
+// the new archive being built, so reopening a path for writing never loses
+// what an earlier run already saved there.
+func carryForwardZipEntry(w *zip.Writer, zf *zip.File) error {
+	src, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := w.CreateHeader(&zip.FileHeader{
+		Name:     zf.Name,
+		Method:   zf.Method,
+		Modified: zf.Modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// zipEntry holds the archive's mutex for the lifetime of one entry, since
+// archive/zip only ever allows a single open writer at a time.
+type zipEntry struct {
+	w      io.Writer
+	unlock func()
+}
+
+func (e *zipEntry) Write(p []byte) (int, error) { return e.w.Write(p) }
+
+func (e *zipEntry) Close() error {
+	e.unlock()
+	return nil
+}
+
+func (o *zipOutput) Create(name string, meta imageMeta) (io.WriteCloser, error) {
+	o.mu.Lock()
+	w, err := o.archive.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: meta.CompletedAt,
+	})
+	if err != nil {
+		o.mu.Unlock()
+		return nil, err
+	}
+	return &zipEntry{w: w, unlock: o.mu.Unlock}, nil
+}
+
+func (o *zipOutput) Finalize() error {
+	if err := o.archive.Close(); err != nil {
+		return fmt.Errorf("could not finalize zip archive: %v", err)
+	}
+	if err := o.file.Close(); err != nil {
+		return fmt.Errorf("could not finalize zip archive: %v", err)
+	}
+	if err := os.Rename(o.tmpPath, o.path); err != nil {
+		return fmt.Errorf("could not replace %s: %v", o.path, err)
+	}
+	return nil
+}
+
+// warcOutput appends each image to a single growing WARC/1.0 archive as a
+// "request" record (the actual request sent to fotolog) followed by a
+// "response" record (status, headers and body), so the real provenance of
+// each image travels with its bytes rather than just the bytes themselves.
+type warcOutput struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newWarcOutput(path string) (*warcOutput, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open warc archive %s: %v", path, err)
+	}
+	return &warcOutput{file: f}, nil
+}
+
+// warcEntry buffers one image's bytes so the response record's
+// Content-Length can be computed before anything is written.
+type warcEntry struct {
+	buf  bytes.Buffer
+	out  *warcOutput
+	meta imageMeta
+}
+
+func (e *warcEntry) Write(p []byte) (int, error) { return e.buf.Write(p) }
+
+func (e *warcEntry) Close() error {
+	return e.out.appendRecords(e.meta, e.buf.Bytes())
+}
+
+func (o *warcOutput) Create(name string, meta imageMeta) (io.WriteCloser, error) {
+	return &warcEntry{out: o, meta: meta}, nil
+}
+
+func (o *warcOutput) Finalize() error {
+	return o.file.Close()
+}
+
+// appendRecords writes the captured request then the captured response
+// (status line, headers and body) for one image as a pair of WARC/1.0
+// records.
+func (o *warcOutput) appendRecords(meta imageMeta, body []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	reqMsg := fmt.Sprintf("%s %s HTTP/1.1\r\n%s\r\n", meta.RequestMethod, meta.ImageURL, formatHeader(meta.RequestHeader))
+	if err := writeWarcRecord(o.file, "request", meta.ImageURL, meta.CompletedAt, meta.SHA256+"-req", []byte(reqMsg)); err != nil {
+		return err
+	}
+
+	respMsg := fmt.Sprintf("HTTP/1.1 %d %s\r\n%s\r\n", meta.ResponseStatus, http.StatusText(meta.ResponseStatus), formatHeader(meta.ResponseHeader))
+	respPayload := append([]byte(respMsg), body...)
+	return writeWarcRecord(o.file, "response", meta.ImageURL, meta.CompletedAt, meta.SHA256, respPayload)
+}
+
+// formatHeader renders h as CRLF-terminated "Name: value" lines.
+func formatHeader(h http.Header) string {
+	var b strings.Builder
+	for k, vs := range h {
+		for _, v := range vs {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+		}
+	}
+	return b.String()
+}
+
+// writeWarcRecord appends one WARC/1.0 record of recordType ("request" or
+// "response") to w.
+func writeWarcRecord(w io.Writer, recordType, targetURI string, date time.Time, recordID string, payload []byte) error {
+	header := fmt.Sprintf(
+		"WARC/1.0\r\nWARC-Type: %s\r\nWARC-Target-URI: %s\r\nWARC-Date: %s\r\nWARC-Record-ID: <urn:fotolog-dl:%s>\r\nContent-Type: application/http;msgtype=%s\r\nContent-Length: %d\r\n\r\n",
+		recordType, targetURI, date.UTC().Format(time.RFC3339), recordID, recordType, len(payload),
+	)
+	if _, err := io.WriteString(w, header); err != nil {
+		return fmt.Errorf("could not write warc record header: %v", err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return fmt.Errorf("could not write warc record body: %v", err)
+	}
+	_, err := io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// cloudStorer is the minimal cloud storage surface this backend needs,
+// modeled on the Upload method shared by bookpipeline's AwsConn/LocalConn
+// connection types so a GCS-backed implementation can be dropped in later.
+type cloudStorer interface {
+	Upload(bucket, key string, body io.Reader) error
+}
+
+// s3Output uploads each image as its own S3 object under bucket/prefix.
+type s3Output struct {
+	store  cloudStorer
+	bucket string
+	prefix string
+}
+
+func newS3Output(bucket, prefix string) (*s3Output, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("could not create AWS session: %v", err)
+	}
+	return &s3Output{
+		store:  &s3Uploader{uploader: s3manager.NewUploader(sess)},
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+// s3Uploader adapts s3manager.Uploader to cloudStorer.
+type s3Uploader struct {
+	uploader *s3manager.Uploader
+}
+
+func (u *s3Uploader) Upload(bucket, key string, body io.Reader) error {
+	_, err := u.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	return err
+}
+
+// s3Entry buffers one image so it can be uploaded as a single S3 object
+// once writing completes.
+type s3Entry struct {
+	buf    bytes.Buffer
+	store  cloudStorer
+	bucket string
+	key    string
+}
+
+func (e *s3Entry) Write(p []byte) (int, error) { return e.buf.Write(p) }
+
+func (e *s3Entry) Close() error {
+	return e.store.Upload(e.bucket, e.key, &e.buf)
+}
+
+func (o *s3Output) Create(name string, meta imageMeta) (io.WriteCloser, error) {
+	key := name
+	if o.prefix != "" {
+		key = o.prefix + "/" + name
+	}
+	return &s3Entry{store: o.store, bucket: o.bucket, key: key}, nil
+}
+
+func (o *s3Output) Finalize() error { return nil }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirOutputCreate(t *testing.T) {
+	out, err := newDirOutput(t.TempDir())
+	if err != nil {
+		t.Fatalf("newDirOutput = %v", err)
+	}
+
+	w, err := out.Create("first.jpg", imageMeta{})
+	if err != nil {
+		t.Fatalf("Create = %v", err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(out.dir, "first.jpg"))
+	if err != nil {
+		t.Fatalf("reading back saved file: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("saved content = %q, want %q", data, "hello")
+	}
+}
+
+func writeZipEntry(t *testing.T, out *zipOutput, name, content string) {
+	t.Helper()
+	w, err := out.Create(name, imageMeta{CompletedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Create(%s) = %v", name, err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("Write(%s) = %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(%s) = %v", name, err)
+	}
+}
+
+func TestZipOutputReopenPreservesPriorEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.zip")
+
+	first, err := newZipOutput(path, false)
+	if err != nil {
+		t.Fatalf("newZipOutput (first session) = %v", err)
+	}
+	writeZipEntry(t, first, "first.jpg", "one")
+	if err := first.Finalize(); err != nil {
+		t.Fatalf("Finalize (first session) = %v", err)
+	}
+
+	second, err := newZipOutput(path, false)
+	if err != nil {
+		t.Fatalf("newZipOutput (second session) = %v", err)
+	}
+	writeZipEntry(t, second, "second.jpg", "two")
+	if err := second.Finalize(); err != nil {
+		t.Fatalf("Finalize (second session) = %v", err)
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("zip.OpenReader = %v", err)
+	}
+	defer r.Close()
+
+	got := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening entry %s: %v", f.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading entry %s: %v", f.Name, err)
+		}
+		got[f.Name] = string(data)
+	}
+
+	want := map[string]string{"first.jpg": "one", "second.jpg": "two"}
+	if len(got) != len(want) {
+		t.Fatalf("zip has %d entries after two sessions, want %d: %v", len(got), len(want), got)
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("entry %s = %q, want %q", name, got[name], content)
+		}
+	}
+}
+
+func TestZipOutputIncrementalDropsPriorEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.zip")
+
+	first, err := newZipOutput(path, false)
+	if err != nil {
+		t.Fatalf("newZipOutput (first session) = %v", err)
+	}
+	writeZipEntry(t, first, "first.jpg", "one")
+	if err := first.Finalize(); err != nil {
+		t.Fatalf("Finalize (first session) = %v", err)
+	}
+
+	second, err := newZipOutput(path, true)
+	if err != nil {
+		t.Fatalf("newZipOutput (incremental session) = %v", err)
+	}
+	writeZipEntry(t, second, "second.jpg", "two")
+	if err := second.Finalize(); err != nil {
+		t.Fatalf("Finalize (incremental session) = %v", err)
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("zip.OpenReader = %v", err)
+	}
+	defer r.Close()
+
+	if len(r.File) != 1 || r.File[0].Name != "second.jpg" {
+		t.Fatalf("incremental zip has %d entries, want just second.jpg", len(r.File))
+	}
+}
+
+func TestWarcOutputAppendsRequestAndResponseRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "images.warc")
+
+	out, err := newWarcOutput(path)
+	if err != nil {
+		t.Fatalf("newWarcOutput = %v", err)
+	}
+
+	meta := imageMeta{
+		ImageURL:       "http://example.com/img/1.jpg",
+		SHA256:         "abc123",
+		CompletedAt:    time.Now(),
+		RequestMethod:  "GET",
+		RequestHeader:  http.Header{"User-Agent": []string{"fotolog-dl"}},
+		ResponseStatus: http.StatusOK,
+		ResponseHeader: http.Header{"Content-Type": []string{"image/jpeg"}},
+	}
+
+	w, err := out.Create("abc123.jpg", meta)
+	if err != nil {
+		t.Fatalf("Create = %v", err)
+	}
+	if _, err := w.Write([]byte("imagebytes")); err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+	if err := out.Finalize(); err != nil {
+		t.Fatalf("Finalize = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	content := string(data)
+
+	if n := strings.Count(content, "WARC-Type: request"); n != 1 {
+		t.Errorf("got %d request records, want 1", n)
+	}
+	if n := strings.Count(content, "WARC-Type: response"); n != 1 {
+		t.Errorf("got %d response records, want 1", n)
+	}
+	if !strings.Contains(content, "User-Agent: fotolog-dl") {
+		t.Error("archive is missing the captured request header")
+	}
+	if !strings.Contains(content, "Content-Type: image/jpeg") {
+		t.Error("archive is missing the captured response header")
+	}
+	if !strings.Contains(content, "imagebytes") {
+		t.Error("archive is missing the image body")
+	}
+}
+
+type fakeCloudStorer struct {
+	bucket, key string
+	body        []byte
+}
+
+func (f *fakeCloudStorer) Upload(bucket, key string, body io.Reader) error {
+	f.bucket, f.key = bucket, key
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	f.body = data
+	return nil
+}
+
+func TestS3OutputUpload(t *testing.T) {
+	fake := &fakeCloudStorer{}
+	out := &s3Output{store: fake, bucket: "my-bucket", prefix: "prefix"}
+
+	w, err := out.Create("abc123.jpg", imageMeta{})
+	if err != nil {
+		t.Fatalf("Create = %v", err)
+	}
+	if _, err := w.Write([]byte("imagebytes")); err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close = %v", err)
+	}
+
+	if fake.bucket != "my-bucket" {
+		t.Errorf("bucket = %q, want my-bucket", fake.bucket)
+	}
+	if fake.key != "prefix/abc123.jpg" {
+		t.Errorf("key = %q, want prefix/abc123.jpg", fake.key)
+	}
+	if !bytes.Equal(fake.body, []byte("imagebytes")) {
+		t.Errorf("body = %q, want imagebytes", fake.body)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// pageJob describes a single mosaic page to fetch.
+type pageJob struct {
+	url  string
+	page int
+}
+
+// pageResult pairs a fetched mosaic page with the document parsed from it.
+type pageResult struct {
+	doc *goquery.Document
+	url string
+}
+
+// pipeline wires the enumerate -> fetch -> parse -> download stages
+// together. Each stage is a fixed-size worker pool reading from a buffered
+// channel, so the crawl never spawns more goroutines than pageWorkers +
+// imageWorkers at a time regardless of how many pages or images a profile
+// has.
+type pipeline struct {
+	client       *http.Client
+	limiter      *rateLimiter
+	retry        *retryPolicy
+	manifest     *manifest
+	progress     *progress
+	output       output
+	errors       *errorSink
+	pageWorkers  int
+	imageWorkers int
+
+	pageChan chan pageJob
+	htmlChan chan pageResult
+	imgChan  chan imageJob
+}
+
+// imageJob pairs an image detail link with the page worker whose bar should
+// be advanced once it finishes downloading, and the WaitGroup that page's
+// links were registered on. worker is -1 and pageWG is nil for links fed in
+// by runURLs, which have no owning page bar.
+type imageJob struct {
+	url    string
+	worker int
+	pageWG *sync.WaitGroup
+}
+
+// pipelineConfig bundles the tunable knobs for a pipeline. The manifest,
+// progress, output and error-sink dependencies it reports to are passed to
+// newPipeline separately since they're collaborators, not settings.
+type pipelineConfig struct {
+	PageWorkers  int
+	ImageWorkers int
+	Timeout      time.Duration
+	RPS          float64
+	MaxRetries   int
+	RetryBase    time.Duration
+}
+
+// newPipeline builds a pipeline from cfg, wired up to m (dedup/resume
+// index), prog (progress bars), out (storage backend) and errs (failed-URL
+// sink).
+func newPipeline(cfg pipelineConfig, m *manifest, prog *progress, out output, errs *errorSink) *pipeline {
+	return &pipeline{
+		client:       &http.Client{Timeout: cfg.Timeout},
+		limiter:      newRateLimiter(cfg.RPS),
+		retry:        &retryPolicy{maxRetries: cfg.MaxRetries, base: cfg.RetryBase},
+		manifest:     m,
+		progress:     prog,
+		output:       out,
+		errors:       errs,
+		pageWorkers:  cfg.PageWorkers,
+		imageWorkers: cfg.ImageWorkers,
+		pageChan:     make(chan pageJob, cfg.PageWorkers*2),
+		htmlChan:     make(chan pageResult, cfg.PageWorkers*2),
+		imgChan:      make(chan imageJob, cfg.ImageWorkers*4),
+	}
+}
+
+// run enumerates pages 0..lastPage (step 30) onto pageChan, starts the page,
+// parse and image worker pools, and blocks until every image has been
+// processed. It returns the total number of images successfully downloaded.
+func (p *pipeline) run(username string, lastPage int) int {
+	defer p.limiter.stop()
+
+	go func() {
+		defer close(p.pageChan)
+		for i := 0; i <= lastPage; i += 30 {
+			p.pageChan <- pageJob{
+				url:  fmt.Sprintf(fotologURL, username, pageSuffix(i)),
+				page: i,
+			}
+		}
+	}()
+
+	var pageWG sync.WaitGroup
+	pageWG.Add(p.pageWorkers)
+	for i := 0; i < p.pageWorkers; i++ {
+		go func() {
+			defer pageWG.Done()
+			p.fetchPages()
+		}()
+	}
+	go func() {
+		pageWG.Wait()
+		close(p.htmlChan)
+	}()
+
+	var parseWG sync.WaitGroup
+	parseWG.Add(p.pageWorkers)
+	for i := 0; i < p.pageWorkers; i++ {
+		worker := i
+		go func() {
+			defer parseWG.Done()
+			p.extractImages(worker)
+		}()
+	}
+	go func() {
+		parseWG.Wait()
+		close(p.imgChan)
+	}()
+
+	var imagesProcessed int64
+	var imgWG sync.WaitGroup
+	imgWG.Add(p.imageWorkers)
+	for i := 0; i < p.imageWorkers; i++ {
+		go func() {
+			defer imgWG.Done()
+			p.downloadImages(&imagesProcessed)
+		}()
+	}
+	imgWG.Wait()
+
+	return int(imagesProcessed)
+}
+
+// runURLs downloads exactly the given detail URLs, skipping page discovery
+// entirely. It's used by -retry-from to re-drive a prior run's failures
+// without re-walking the profile from page 1.
+func (p *pipeline) runURLs(urls []string) int {
+	defer p.limiter.stop()
+
+	go func() {
+		defer close(p.imgChan)
+		for _, u := range urls {
+			p.imgChan <- imageJob{url: u, worker: -1}
+		}
+	}()
+
+	var imagesProcessed int64
+	var imgWG sync.WaitGroup
+	imgWG.Add(p.imageWorkers)
+	for i := 0; i < p.imageWorkers; i++ {
+		go func() {
+			defer imgWG.Done()
+			p.downloadImages(&imagesProcessed)
+		}()
+	}
+	imgWG.Wait()
+
+	return int(imagesProcessed)
+}
+
+// pageSuffix returns the fotologURL page segment for page, matching the
+// site's pagination scheme where the first page has no suffix.
+func pageSuffix(page int) string {
+	if page == 0 {
+		return ""
+	}
+	return strconv.Itoa(page)
+}
+
+// fetchPages reads page URLs off pageChan, fetches and parses each one, and
+// forwards the resulting document to htmlChan.
+func (p *pipeline) fetchPages() {
+	for job := range p.pageChan {
+		p.limiter.wait()
+		resp, err := p.retry.get(p.client, job.url)
+		if err != nil {
+			log.Printf("could not fetch page %s: %v", job.url, err)
+			continue
+		}
+		doc, err := goquery.NewDocumentFromReader(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("could not parse page %s: %v", job.url, err)
+			continue
+		}
+		p.htmlChan <- pageResult{doc: doc, url: job.url}
+	}
+}
+
+// extractImages walks each parsed mosaic page for image detail links,
+// sizing worker's progress bar to the number found, and forwards them to
+// imgChan. The bar itself advances in downloadImages, once each image
+// actually finishes, not here at enqueue time. Before reusing worker's bar
+// for the next page, it waits for every link just queued to be claimed by a
+// downloadImages call for the current page's pageWG, so a bar reset never
+// races with in-flight increments meant for the page it's replacing.
+func (p *pipeline) extractImages(worker int) {
+	var pageWG *sync.WaitGroup
+	for res := range p.htmlChan {
+		if pageWG != nil {
+			pageWG.Wait()
+		}
+
+		var links []string
+		res.doc.Find("a.wall_img_container").Each(func(i int, s *goquery.Selection) {
+			if link, ok := s.Attr("href"); ok {
+				links = append(links, link)
+			}
+		})
+		p.progress.startPage(worker, res.url, len(links))
+
+		pageWG = &sync.WaitGroup{}
+		pageWG.Add(len(links))
+		for _, link := range links {
+			p.imgChan <- imageJob{url: link, worker: worker, pageWG: pageWG}
+		}
+	}
+}
+
+// downloadImages reads image jobs off imgChan and hands them to
+// processImage, counting successes into processed, sinking exhausted
+// failures to errors.jsonl, advancing the owning page's bar once each image
+// is actually done, and marking it off that page's pageWG so the owning
+// parse worker knows it's safe to reuse the bar for its next page.
+func (p *pipeline) downloadImages(processed *int64) {
+	for job := range p.imgChan {
+		p.limiter.wait()
+		err := processImage(p.client, p.retry, p.manifest, p.progress, p.output, job.url)
+		p.progress.recordResult(err)
+		if job.worker >= 0 {
+			p.progress.pageProgress(job.worker)
+		}
+		if job.pageWG != nil {
+			job.pageWG.Done()
+		}
+		if err != nil {
+			log.Printf("could not process image %s: %v", job.url, err)
+			if sErr := p.errors.record(job.url, err); sErr != nil {
+				log.Printf("could not record error for %s: %v", job.url, sErr)
+			}
+			continue
+		}
+		atomic.AddInt64(processed, 1)
+	}
+}
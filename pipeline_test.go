@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestPageSuffix(t *testing.T) {
+	cases := []struct {
+		page int
+		want string
+	}{
+		{0, ""},
+		{30, "30"},
+		{300, "300"},
+	}
+	for _, c := range cases {
+		if got := pageSuffix(c.page); got != c.want {
+			t.Errorf("pageSuffix(%d) = %q, want %q", c.page, got, c.want)
+		}
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	rl := newRateLimiter(0)
+	if rl != nil {
+		t.Fatalf("newRateLimiter(0) = %v, want nil", rl)
+	}
+	// wait and stop must be no-ops on a nil limiter.
+	rl.wait()
+	rl.stop()
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	rl := newRateLimiter(1000)
+	defer rl.stop()
+
+	// A handful of waits should complete without blocking the test.
+	for i := 0; i < 3; i++ {
+		rl.wait()
+	}
+}
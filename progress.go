@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+
+	pb "github.com/cheggaaa/pb/v3"
+)
+
+// progress renders a multi-bar view of the crawl: one bar per page worker
+// showing how many images were found on its current page, plus a "Total"
+// bar tracking bytes downloaded across all image workers. With -quiet the
+// bars aren't rendered, but the same counters are still kept so a final
+// summary can be printed.
+type progress struct {
+	quiet bool
+
+	pool     *pb.Pool
+	pageBars []*pb.ProgressBar
+	total    *pb.ProgressBar
+
+	imagesOK   int64
+	imagesFail int64
+}
+
+// newProgress creates one bar per page worker plus a running total bytes
+// bar, starting the pool unless quiet is set.
+func newProgress(pageWorkers int, quiet bool) (*progress, error) {
+	p := &progress{quiet: quiet}
+
+	p.total = pb.New64(0)
+	p.total.Set(pb.Bytes, true)
+	p.total.SetTemplateString(`Total {{counters . }} {{bar . }} {{speed . }}`)
+
+	bars := make([]*pb.ProgressBar, 0, pageWorkers+1)
+	for i := 0; i < pageWorkers; i++ {
+		worker := i
+		bar := pb.New(0)
+		bar.SetTemplateString(fmt.Sprintf(`worker %d: {{string . "page"}} {{counters . }} {{bar . }}`, worker))
+		bar.Set("page", "waiting...")
+		p.pageBars = append(p.pageBars, bar)
+		bars = append(bars, bar)
+	}
+	bars = append(bars, p.total)
+
+	if quiet {
+		return p, nil
+	}
+
+	pool, err := pb.StartPool(bars...)
+	if err != nil {
+		return nil, fmt.Errorf("could not start progress pool: %v", err)
+	}
+	p.pool = pool
+	return p, nil
+}
+
+// startPage resets worker's bar to track a newly fetched page carrying
+// total images.
+func (p *progress) startPage(worker int, url string, total int) {
+	bar := p.pageBars[worker]
+	bar.SetCurrent(0)
+	bar.SetTotal(int64(total))
+	bar.Set("page", url)
+	if p.quiet {
+		log.Println("Processing", url)
+	}
+}
+
+// pageProgress advances worker's page bar by one completed image.
+func (p *progress) pageProgress(worker int) {
+	p.pageBars[worker].Increment()
+}
+
+// recordResult updates the overall success/failure counters used by the
+// final summary.
+func (p *progress) recordResult(err error) {
+	if err != nil {
+		atomic.AddInt64(&p.imagesFail, 1)
+		return
+	}
+	atomic.AddInt64(&p.imagesOK, 1)
+}
+
+// wrap returns r wrapped so each Read adds to the total bytes bar.
+func (p *progress) wrap(r io.Reader) io.Reader {
+	return p.total.NewProxyReader(r)
+}
+
+// finish stops the bar pool (if running) and returns the final counters for
+// the summary line.
+func (p *progress) finish() (images, failures, bytes int64) {
+	if !p.quiet {
+		p.pool.Stop()
+	}
+	return atomic.LoadInt64(&p.imagesOK), atomic.LoadInt64(&p.imagesFail), p.total.Current()
+}
@@ -0,0 +1,58 @@
+package main
+
+import "time"
+
+// rateLimiter is a simple token-bucket limiter used to throttle outgoing
+// requests to a configurable requests-per-second budget.
+type rateLimiter struct {
+	tokens chan struct{}
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+// newRateLimiter starts a background goroutine that refills one token every
+// 1/rps seconds. An rps <= 0 returns nil, which disables throttling.
+func newRateLimiter(rps float64) *rateLimiter {
+	if rps <= 0 {
+		return nil
+	}
+
+	rl := &rateLimiter{
+		tokens: make(chan struct{}, 1),
+		ticker: time.NewTicker(time.Duration(float64(time.Second) / rps)),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-rl.ticker.C:
+				select {
+				case rl.tokens <- struct{}{}:
+				default:
+				}
+			case <-rl.done:
+				return
+			}
+		}
+	}()
+
+	return rl
+}
+
+// wait blocks until a token is available. It is a no-op on a nil limiter.
+func (rl *rateLimiter) wait() {
+	if rl == nil {
+		return
+	}
+	<-rl.tokens
+}
+
+// stop releases the limiter's background goroutine and ticker.
+func (rl *rateLimiter) stop() {
+	if rl == nil {
+		return
+	}
+	rl.ticker.Stop()
+	close(rl.done)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errorsPath is where failed image URLs are recorded, for later recovery
+// via -retry-from.
+const errorsPath = "./errors.jsonl"
+
+// retryPolicy governs how a fetch is retried on transient failures:
+// network errors, 5xx responses, and 429s (honoring Retry-After).
+type retryPolicy struct {
+	maxRetries int
+	base       time.Duration
+}
+
+// retryError carries the final retry bookkeeping for a fetch that never
+// succeeded, so callers can record it to errors.jsonl.
+type retryError struct {
+	attempts   int
+	lastStatus int
+	err        error
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+// get fetches url via client, retrying up to p.maxRetries times with
+// exponential backoff plus jitter on network errors, 5xx responses, and
+// 429s. A 429's Retry-After header, when present, is honored in place of
+// the computed backoff.
+func (p *retryPolicy) get(client *http.Client, url string) (*http.Response, error) {
+	var lastErr error
+	lastStatus := 0
+	attempts := 0
+
+	for attempt := 0; attempt <= p.maxRetries; attempt++ {
+		attempts++
+		resp, err := client.Get(url)
+		if err != nil {
+			lastErr = err
+			if attempt < p.maxRetries {
+				time.Sleep(p.backoff(attempt))
+			}
+			continue
+		}
+
+		if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+
+		lastStatus = resp.StatusCode
+		lastErr = fmt.Errorf("status %d", resp.StatusCode)
+		wait := p.backoff(attempt)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if ra := retryAfter(resp.Header.Get("Retry-After")); ra > 0 {
+				wait = ra
+			}
+		}
+		resp.Body.Close()
+		if attempt < p.maxRetries {
+			time.Sleep(wait)
+		}
+	}
+
+	return nil, &retryError{attempts: attempts, lastStatus: lastStatus, err: lastErr}
+}
+
+// backoff returns the exponential-backoff-plus-jitter delay for the given
+// 0-indexed attempt.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	if attempt > 20 {
+		attempt = 20 // avoid overflowing the shift for pathological -max-retries
+	}
+	d := p.base << attempt
+	return d/2 + time.Duration(rand.Int63n(int64(d)+1))
+}
+
+// retryAfter parses a Retry-After header given in seconds, returning 0 if
+// it's absent or not a plain integer.
+func retryAfter(v string) time.Duration {
+	secs, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// errorEntry records one image that could not be downloaded, for later
+// recovery via -retry-from.
+type errorEntry struct {
+	URL        string `json:"url"`
+	Attempts   int    `json:"attempts"`
+	LastStatus int    `json:"last_status"`
+	LastError  string `json:"last_error"`
+}
+
+// errorSink appends failed URLs to errors.jsonl as they occur.
+type errorSink struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func newErrorSink(path string) (*errorSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create %s: %v", path, err)
+	}
+	return &errorSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// record appends entry as one more line of errors.jsonl, deriving it from
+// err when err is a *retryError.
+func (s *errorSink) record(url string, err error) error {
+	entry := errorEntry{URL: url, Attempts: 1, LastError: err.Error()}
+	if re, ok := err.(*retryError); ok {
+		entry.Attempts = re.attempts
+		entry.LastStatus = re.lastStatus
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(entry)
+}
+
+func (s *errorSink) close() error {
+	return s.file.Close()
+}
+
+// loadErrorURLs reads the URLs recorded in a prior run's errors.jsonl, for
+// use with -retry-from.
+func loadErrorURLs(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+
+	var urls []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var e errorEntry
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", path, err)
+		}
+		urls = append(urls, e.URL)
+	}
+	return urls, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestRetryPolicyBackoffBounds(t *testing.T) {
+	rp := &retryPolicy{maxRetries: 5, base: 100}
+	for attempt := 0; attempt < 5; attempt++ {
+		d := rp.backoff(attempt)
+		full := rp.base << attempt
+		min := full / 2
+		max := min + full
+		if d < min || d > max {
+			t.Errorf("backoff(%d) = %d, want in [%d, %d]", attempt, d, min, max)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffClampsAttempt(t *testing.T) {
+	rp := &retryPolicy{maxRetries: 100, base: 1}
+	// A pathologically large attempt must not overflow the shift.
+	if d := rp.backoff(1000); d < 0 {
+		t.Errorf("backoff(1000) = %d, want non-negative", d)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"not-a-number", 0},
+		{"0", 0},
+		{"30", 30},
+	}
+	for _, c := range cases {
+		if got := retryAfter(c.in); got.Seconds() != float64(c.want) {
+			t.Errorf("retryAfter(%q) = %v, want %ds", c.in, got, c.want)
+		}
+	}
+}